@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/oc"
+	eventstypes "github.com/containerd/containerd/api/events"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/ttrpc"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// ttrpcEventsEnvVar opts the shim into forwarding events over a persistent
+// TTRPC connection to containerd's events service instead of fork+exec'ing
+// `containerd publish` for every event. It is read once at shim startup by
+// `newPublisher`.
+const ttrpcEventsEnvVar = "HCSSHIM_TTRPC_EVENTS_ADDRESS"
+
+var _ = (publisher)((&ttrpcPublisher{}).publish)
+
+// newPublisher returns the event publisher this shim process should use:
+// a `ttrpcPublisher` dialed against the address in `ttrpcEventsEnvVar` if
+// set and reachable, falling back to the fork-exec based `publishEvent`
+// otherwise.
+func newPublisher(ctx context.Context) publisher {
+	address := os.Getenv(ttrpcEventsEnvVar)
+	if address == "" {
+		return publishEvent
+	}
+	p := &ttrpcPublisher{address: address, namespace: namespaceFlag}
+	if _, err := p.dial(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"address":       address,
+			logrus.ErrorKey: err,
+		}).Warn("failed to dial containerd events service, falling back to publish binary")
+		return publishEvent
+	}
+	return p.publish
+}
+
+// ttrpcPublisher forwards events directly to containerd's events service
+// over a single, lazily (re)dialed TTRPC connection, avoiding the per-event
+// fork+exec of `containerd publish` that `publishEvent` pays.
+type ttrpcPublisher struct {
+	address   string
+	namespace string
+
+	m      sync.Mutex
+	conn   *ttrpc.Client
+	client eventsapi.EventsClient
+}
+
+func (p *ttrpcPublisher) dial() (eventsapi.EventsClient, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.client != nil {
+		return p.client, nil
+	}
+	conn, err := ttrpc.Dial(p.address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial containerd events socket")
+	}
+	p.conn = conn
+	p.client = eventsapi.NewEventsClient(conn)
+	return p.client, nil
+}
+
+// reset drops the current connection so the next publish redials, used
+// after a publish fails in case the socket has gone stale.
+func (p *ttrpcPublisher) reset() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = nil
+	p.client = nil
+}
+
+func (p *ttrpcPublisher) publish(ctx context.Context, topic string, event interface{}) (err error) {
+	ctx, span := trace.StartSpan(ctx, "ttrpcPublisher::publish")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(trace.StringAttribute("topic", topic))
+
+	encoded, err := typeurl.MarshalAny(event)
+	if err != nil {
+		return errors.Wrap(err, "encode failed")
+	}
+
+	client, err := p.dial()
+	if err != nil {
+		return err
+	}
+
+	req := &eventsapi.ForwardRequest{
+		Envelope: &eventstypes.Envelope{
+			Timestamp: time.Now(),
+			Namespace: p.namespace,
+			Topic:     topic,
+			Event:     encoded,
+		},
+	}
+	if _, err := client.Forward(ctx, req); err != nil {
+		// The connection may have gone stale (containerd restarted); drop
+		// it so the next publish redials instead of repeating this error
+		// for the lifetime of the shim.
+		p.reset()
+		return errors.Wrap(err, "forward failed")
+	}
+	return nil
+}
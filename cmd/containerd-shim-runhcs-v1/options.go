@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	typeurl.Register(&HcsOptions{}, "containerd.runhcs.v1", "HcsOptions")
+}
+
+// UVMOptions is the subset of `uvm.Options*` fields that can be overridden
+// per task through `HcsOptions.UVMOptions`, taking precedence over whatever
+// `oci.SpecToUVMCreateOpts` derived from the OCI spec/annotations.
+type UVMOptions struct {
+	MemorySizeInMB uint64
+	ProcessorCount int32
+}
+
+// HcsOptions carries shim-specific create-time configuration decoded from
+// `task.CreateTaskRequest.Options`. It is the structured counterpart to the
+// configuration the shim otherwise only accepts via OCI spec annotations.
+type HcsOptions struct {
+	// IoUID/IoGID set the uid/gid that own the init exec's IO pipes on the
+	// host.
+	IoUID uint32
+	IoGID uint32
+	// CriuPath overrides the CRIU binary used for Checkpoint/Restore, see
+	// `CheckpointOptions.CriuPath`.
+	CriuPath string
+	// BootFilesRoot overrides the default LCOW boot files directory.
+	BootFilesRoot string
+	// UVMOptions, when set, is merged over the UVM options derived from the
+	// OCI spec before the UVM is created.
+	UVMOptions *UVMOptions
+}
+
+// hcsOptionsFromRequest decodes `req.Options`, if present, into an
+// `HcsOptions`. A nil `req.Options` is not an error; it returns `nil, nil`
+// and callers should fall back to annotation-derived defaults.
+//
+// If `req.Options` is set but decodes to a different type (e.g. a
+// `runctypes.CreateOptions` carried over from a mixed cluster) it is
+// ignored rather than treated as an error.
+func hcsOptionsFromRequest(req *task.CreateTaskRequest) (*HcsOptions, error) {
+	if req.Options == nil {
+		return nil, nil
+	}
+	v, err := typeurl.UnmarshalAny(req.Options)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal task create options")
+	}
+	opts, ok := v.(*HcsOptions)
+	if !ok {
+		return nil, nil
+	}
+	return opts, nil
+}
@@ -45,4 +45,15 @@ type shimTask interface {
 	// Pids returns all process pid's in this `shimTask` including ones not
 	// created by the caller via a `CreateExec`.
 	Pids(ctx context.Context) ([]shimTaskPidPair, error)
+	// Checkpoint checkpoints this task's container and all of its execs to
+	// `path` so that the task can later be recreated via a `Restore` of the
+	// same directory.
+	//
+	// `path` MUST be a directory, empty or not yet existing, that this task
+	// owns for the duration of the call.
+	//
+	// This task MUST be in a state where the init exec is
+	// `shimExecStateRunning` or this call MUST return
+	// `errdefs.ErrFailedPrecondition`.
+	Checkpoint(ctx context.Context, path string, opts *CheckpointOptions) error
 }
\ No newline at end of file
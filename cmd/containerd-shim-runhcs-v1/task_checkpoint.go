@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/containerd/runtime/v2/task"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// specProvider is implemented by exec types that retain their original
+// process spec, letting Checkpoint capture it without widening the
+// `shimExec` interface for every implementation.
+type specProvider interface {
+	Spec() *specs.Process
+}
+
+func execSpec(e shimExec) *specs.Process {
+	if sp, ok := e.(specProvider); ok {
+		return sp.Spec()
+	}
+	return nil
+}
+
+// checkpointStateFileName is the name of the manifest written alongside the
+// HCS/CRIU snapshot artifacts in the directory passed to `hcsTask.Checkpoint`.
+const checkpointStateFileName = "shim-state.json"
+
+// CheckpointOptions controls how `hcsTask.Checkpoint` takes a checkpoint.
+// `newHcsTaskFromCheckpoint` does not take these options on restore.
+type CheckpointOptions struct {
+	// Exit tears the container down after a successful checkpoint, turning
+	// the call into a "checkpoint and exit" as used for node draining.
+	Exit bool
+	// CriuPath overrides the CRIU binary invoked inside the UVM for an LCOW
+	// checkpoint. If empty the task's create-time `HcsOptions.CriuPath` is
+	// used, and if that is empty too the GCS's default `criu` on `PATH`.
+	CriuPath string
+}
+
+// execCheckpoint is the on-disk representation of a single exec captured as
+// part of a task checkpoint. It carries just enough to rehydrate
+// `hcsTask.execs` bookkeeping in `newHcsTaskFromCheckpoint`; the process
+// memory/state itself lives in the HCS/CRIU snapshot under the same
+// directory.
+type execCheckpoint struct {
+	ID     string         `json:"id"`
+	Bundle string         `json:"bundle"`
+	Spec   *specs.Process `json:"spec"`
+}
+
+// taskCheckpoint is the manifest written to `checkpointStateFileName`.
+type taskCheckpoint struct {
+	ID     string           `json:"id"`
+	IsWCOW bool             `json:"isWCOW"`
+	Init   execCheckpoint   `json:"init"`
+	Execs  []execCheckpoint `json:"execs"`
+}
+
+// checkpointExecs captures every additional exec tracked in `execs` (every
+// entry besides the task's init exec) into an `execCheckpoint`, in the order
+// `sync.Map.Range` happens to enumerate them.
+func checkpointExecs(execs *sync.Map) []execCheckpoint {
+	var out []execCheckpoint
+	execs.Range(func(key, value interface{}) bool {
+		he := value.(shimExec)
+		out = append(out, execCheckpoint{
+			ID:     he.ID(),
+			Bundle: he.Status().Bundle,
+			Spec:   execSpec(he),
+		})
+		return true
+	})
+	return out
+}
+
+// Checkpoint writes the state required to `Restore` this task to `path` and
+// asks the HCS (and, for LCOW, CRIU running inside the UVM via the GCS
+// bridge) to snapshot the container's processes there as well.
+//
+// `path` MUST be a directory that either does not exist or is empty; it is
+// created if missing.
+func (ht *hcsTask) Checkpoint(ctx context.Context, path string, opts *CheckpointOptions) error {
+	logrus.WithFields(logrus.Fields{
+		"tid":  ht.id,
+		"path": path,
+	}).Debug("hcsTask::Checkpoint")
+
+	if ht.init.State() != shimExecStateRunning {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "task: '%s' must be running to checkpoint", ht.id)
+	}
+	if opts == nil {
+		opts = &CheckpointOptions{}
+	}
+	criuPath := opts.CriuPath
+	if criuPath == "" {
+		criuPath = ht.criuPath
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create checkpoint directory: '%s'", path)
+	}
+
+	if err := ht.c.Checkpoint(path, criuPath); err != nil {
+		return errors.Wrapf(err, "failed to checkpoint container: '%s'", ht.id)
+	}
+
+	tc := taskCheckpoint{
+		ID:     ht.id,
+		IsWCOW: ht.isWCOW,
+		Init: execCheckpoint{
+			ID:     ht.init.ID(),
+			Bundle: ht.init.Status().Bundle,
+			Spec:   execSpec(ht.init),
+		},
+	}
+	tc.Execs = checkpointExecs(&ht.execs)
+
+	data, err := json.Marshal(&tc)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal checkpoint state")
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, checkpointStateFileName), data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write checkpoint state")
+	}
+
+	ht.events(
+		runtime.TaskCheckpointedEventTopic,
+		&eventstypes.TaskCheckpointed{
+			ContainerID: ht.id,
+			Checkpoint:  path,
+		})
+
+	if opts.Exit {
+		return ht.init.Kill(ctx, uint32(9))
+	}
+	return nil
+}
+
+// newHcsTaskFromCheckpoint recreates a task previously written by
+// `hcsTask.Checkpoint` at `checkpointPath`, restoring the container from the
+// HCS/CRIU snapshot inside `parent` (if any) and rehydrating `ht.execs` from
+// the checkpoint manifest. The additional execs are recreated without IO
+// relays, and no OOM watcher is registered for the restored task.
+//
+// `newHcsStandaloneTask` routes here instead of `newHcsTask` whenever the
+// incoming `CreateTaskRequest.Checkpoint` is set, passing it through as
+// `checkpointPath`.
+func newHcsTaskFromCheckpoint(
+	ctx context.Context,
+	events publisher,
+	parent *uvm.UtilityVM,
+	ownsParent bool,
+	checkpointPath string,
+	req *task.CreateTaskRequest,
+	s *specs.Spec) (shimTask, error) {
+	logrus.WithFields(logrus.Fields{
+		"tid":            req.ID,
+		"checkpointPath": checkpointPath,
+	}).Debug("newHcsTaskFromCheckpoint")
+
+	data, err := ioutil.ReadFile(filepath.Join(checkpointPath, checkpointStateFileName))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read checkpoint state")
+	}
+	var tc taskCheckpoint
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal checkpoint state")
+	}
+
+	hopts, err := hcsOptionsFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	io, err := newRelay(ctx, req.Stdin, req.Stdout, req.Stderr, req.Terminal)
+	if err != nil {
+		return nil, err
+	}
+
+	var netNS string
+	if s.Windows != nil && s.Windows.Network != nil {
+		netNS = s.Windows.Network.NetworkNamespace
+	}
+	opts := hcsoci.CreateOptions{
+		ID:               req.ID,
+		Owner:            owner,
+		Spec:             s,
+		HostingSystem:    parent,
+		NetworkNamespace: netNS,
+		RestoreFromPath:  checkpointPath,
+	}
+	system, resources, err := hcsoci.CreateContainer(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ht := &hcsTask{
+		events:   events,
+		id:       req.ID,
+		isWCOW:   tc.IsWCOW,
+		c:        system,
+		cr:       resources,
+		ownsHost: ownsParent,
+		host:     parent,
+	}
+	if hopts != nil {
+		ht.criuPath = hopts.CriuPath
+	}
+	ht.init = newHcsExec(
+		ctx,
+		events,
+		req.ID,
+		parent,
+		system,
+		tc.Init.ID,
+		tc.Init.Bundle,
+		ht.isWCOW,
+		tc.Init.Spec,
+		io)
+
+	for _, ec := range tc.Execs {
+		he := newHcsExec(ctx, events, req.ID, parent, system, ec.ID, ec.Bundle, ht.isWCOW, ec.Spec, nil)
+		ht.execs.Store(ec.ID, he)
+	}
+
+	go ht.waitForExit()
+
+	return ht, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCheckpointExecs_MultipleExecs(t *testing.T) {
+	execs := &sync.Map{}
+	want := map[string]int{
+		"exec-1": 10,
+		"exec-2": 11,
+		"exec-3": 12,
+	}
+	for id, pid := range want {
+		execs.Store(id, &testShimExec{id: id, pid: pid})
+	}
+
+	got := checkpointExecs(execs)
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d execs, want %d: %v", len(got), len(want), got)
+	}
+	seen := make(map[string]bool)
+	for _, ec := range got {
+		if _, ok := want[ec.ID]; !ok {
+			t.Errorf("unexpected exec %q in checkpoint", ec.ID)
+			continue
+		}
+		seen[ec.ID] = true
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("exec %q missing from checkpoint", id)
+		}
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"time"
 
 	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hcs/schema1"
 	"github.com/Microsoft/hcsshim/internal/hcsoci"
 	"github.com/Microsoft/hcsshim/internal/oci"
+	"github.com/Microsoft/hcsshim/internal/oom"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/Microsoft/hcsshim/osversion"
 	eventstypes "github.com/containerd/containerd/api/events"
@@ -42,6 +44,11 @@ func newHcsStandaloneTask(ctx context.Context, events publisher, req *task.Creat
 
 	owner := filepath.Base(os.Args[0])
 
+	hopts, err := hcsOptionsFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
 	var parent *uvm.UtilityVM
 	if osversion.Get().Build >= osversion.RS5 && oci.IsIsolated(s) {
 		// Create the UVM parent
@@ -52,6 +59,17 @@ func newHcsStandaloneTask(ctx context.Context, events publisher, req *task.Creat
 		switch opts.(type) {
 		case *uvm.OptionsLCOW:
 			lopts := (opts).(*uvm.OptionsLCOW)
+			if hopts != nil {
+				if hopts.BootFilesRoot != "" {
+					lopts.BootFilesPath = hopts.BootFilesRoot
+				}
+				if hopts.UVMOptions != nil && hopts.UVMOptions.MemorySizeInMB != 0 {
+					lopts.MemorySizeInMB = hopts.UVMOptions.MemorySizeInMB
+				}
+				if hopts.UVMOptions != nil && hopts.UVMOptions.ProcessorCount != 0 {
+					lopts.ProcessorCount = hopts.UVMOptions.ProcessorCount
+				}
+			}
 			parent, err = uvm.CreateLCOW(lopts)
 			if err != nil {
 				return nil, err
@@ -74,6 +92,15 @@ func newHcsStandaloneTask(ctx context.Context, events publisher, req *task.Creat
 			layers[layersLen-1] = vmPath
 			wopts.LayerFolders = layers
 
+			if hopts != nil && hopts.UVMOptions != nil {
+				if hopts.UVMOptions.MemorySizeInMB != 0 {
+					wopts.MemorySizeInMB = hopts.UVMOptions.MemorySizeInMB
+				}
+				if hopts.UVMOptions.ProcessorCount != 0 {
+					wopts.ProcessorCount = hopts.UVMOptions.ProcessorCount
+				}
+			}
+
 			parent, err = uvm.CreateWCOW(wopts)
 			if err != nil {
 				return nil, err
@@ -87,7 +114,12 @@ func newHcsStandaloneTask(ctx context.Context, events publisher, req *task.Creat
 		return nil, errors.Wrap(errdefs.ErrFailedPrecondition, "oci spec does not contain WCOW or LCOW spec")
 	}
 
-	shim, err := newHcsTask(ctx, events, parent, true, req, s)
+	var shim shimTask
+	if req.Checkpoint != "" {
+		shim, err = newHcsTaskFromCheckpoint(ctx, events, parent, true, req.Checkpoint, req, s)
+	} else {
+		shim, err = newHcsTask(ctx, events, parent, true, req, s)
+	}
 	if err != nil {
 		if parent != nil {
 			parent.Close()
@@ -97,6 +129,24 @@ func newHcsStandaloneTask(ctx context.Context, events publisher, req *task.Creat
 	return shim, nil
 }
 
+// releaseContainerResources tears down a container created by
+// `hcsoci.CreateContainer` when `newHcsTask` fails after that point, so a
+// partially constructed task doesn't leak the container handle or its
+// resources (for a hypervisor-isolated task, those held inside the caller's
+// UVM). The UVM itself is not closed here.
+func releaseContainerResources(system *hcs.System, resources *hcsoci.Resources, parent *uvm.UtilityVM) {
+	if err := hcsoci.ReleaseResources(resources, parent, true); err != nil {
+		logrus.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+		}).Error("newHcsTask: failed to release container resources")
+	}
+	if err := system.Close(); err != nil && !hcs.IsAlreadyClosed(err) {
+		logrus.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+		}).Error("newHcsTask: failed to close container")
+	}
+}
+
 // newHcsTask creates a container within `parent` and its init exec process in
 // the `shimExecCreated` state and returns the task that tracks its lifetime.
 //
@@ -113,6 +163,11 @@ func newHcsTask(
 		"ownsParent": ownsParent,
 	}).Debug("newHcsTask")
 
+	hopts, err := hcsOptionsFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
 	owner, err := os.Executable()
 	if err != nil {
 		return nil, err
@@ -135,6 +190,10 @@ func newHcsTask(
 		HostingSystem:    parent,
 		NetworkNamespace: netNS,
 	}
+	if hopts != nil {
+		opts.IoUID = hopts.IoUID
+		opts.IoGID = hopts.IoGID
+	}
 	system, resources, err := hcsoci.CreateContainer(&opts)
 	if err != nil {
 		return nil, err
@@ -149,6 +208,9 @@ func newHcsTask(
 		ownsHost: ownsParent,
 		host:     parent,
 	}
+	if hopts != nil {
+		ht.criuPath = hopts.CriuPath
+	}
 	ht.init = newHcsExec(
 		ctx,
 		events,
@@ -161,6 +223,27 @@ func newHcsTask(
 		s.Process,
 		io)
 
+	oomHandler := func(id string) {
+		ht.events(
+			runtime.TaskOOMEventTopic,
+			&eventstypes.TaskOOM{
+				ContainerID: id,
+			})
+	}
+	if ht.isWCOW {
+		ht.oom, err = oom.NewWCOWWatcher(oomHandler)
+	} else {
+		ht.oom, err = oom.NewLCOWWatcher(parent, oomHandler)
+	}
+	if err != nil {
+		releaseContainerResources(system, resources, parent)
+		return nil, errors.Wrap(err, "failed to create oom watcher")
+	}
+	if err := ht.oom.Add(req.ID, system); err != nil {
+		releaseContainerResources(system, resources, parent)
+		return nil, errors.Wrap(err, "failed to register container with oom watcher")
+	}
+
 	// Issue the background wait
 	go ht.waitForExit()
 
@@ -227,6 +310,17 @@ type hcsTask struct {
 	// NOTE: if `osversion.Get().Build < osversion.RS5` this will always be
 	// `nil`.
 	host *uvm.UtilityVM
+	// oom watches this task's container for out-of-memory conditions and
+	// publishes `TaskOOM` events on its behalf. It is set up once, in
+	// `newHcsTask` (the only place that registers it; `newHcsStandaloneTask`
+	// gets it by calling through to `newHcsTask`), and unregistered in
+	// `waitForExit`. A task restored via `newHcsTaskFromCheckpoint` leaves it
+	// nil and publishes no `TaskOOM` events.
+	oom oom.Watcher
+	// criuPath is the CRIU binary override requested at create time via
+	// `HcsOptions.CriuPath`, used as the default for `Checkpoint` when the
+	// caller's `CheckpointOptions.CriuPath` is left empty.
+	criuPath string
 
 	// ecl is the exec create lock for all non-init execs and MUST be held
 	// durring create to prevent ID duplication.
@@ -391,12 +485,48 @@ func (ht *hcsTask) DeleteExec(ctx context.Context, eid string) (int, uint32, tim
 	return int(status.Pid), status.ExitStatus, status.ExitedAt, nil
 }
 
+// indexExecPIDs builds a pid -> execID map covering every additional exec
+// tracked in `execs` (every entry besides the task's init exec), for `Pids`
+// to merge with the HCS process list.
+func indexExecPIDs(execs *sync.Map) map[int]string {
+	pidToEID := make(map[int]string)
+	execs.Range(func(key, value interface{}) bool {
+		ex := value.(shimExec)
+		pidToEID[ex.Pid()] = ex.ID()
+		return true
+	})
+	return pidToEID
+}
+
+// Pids returns all pids for all processes running in the container
+// including ones not created via `CreateExec`, correlating each with its
+// `ExecID` when it was.
 func (ht *hcsTask) Pids(ctx context.Context) ([]shimTaskPidPair, error) {
 	logrus.WithFields(logrus.Fields{
 		"tid": ht.id,
 	}).Debug("hcsTask::Pids")
 
-	return nil, errdefs.ErrNotImplemented
+	// Index the pids of the execs we know about so we can attach their
+	// `ExecID` to the matching entry in the HCS process list below.
+	pidToEID := indexExecPIDs(&ht.execs)
+	if _, ok := pidToEID[ht.init.Pid()]; !ok {
+		pidToEID[ht.init.Pid()] = ht.init.ID()
+	}
+
+	props, err := ht.c.Properties(ctx, schema1.PropertyTypeProcessList)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query container process list")
+	}
+
+	pairs := make([]shimTaskPidPair, 0, len(props.ProcessList))
+	for _, p := range props.ProcessList {
+		pid := int(p.ProcessId)
+		pairs = append(pairs, shimTaskPidPair{
+			Pid:    pid,
+			ExecID: pidToEID[pid],
+		})
+	}
+	return pairs, nil
 }
 
 // waitForExit waits for the init process exit and shuts down the container that
@@ -413,6 +543,15 @@ func (ht *hcsTask) waitForExit() {
 	// Wait for the init task to exit.
 	ht.init.Wait(context.Background())
 
+	if ht.oom != nil {
+		if err := ht.oom.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"tid":           ht.id,
+				logrus.ErrorKey: err,
+			}).Error("hcsTask::close - failed to close oom watcher")
+		}
+	}
+
 	// ht.c should never be nil for a real task but in testing we stub
 	// this to avoid a nil dereference. We really should introduce a
 	// method or interface for ht.c operations that we can stub for
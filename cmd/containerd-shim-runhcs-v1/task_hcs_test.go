@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIndexExecPIDs_MultipleExecs(t *testing.T) {
+	execs := &sync.Map{}
+	want := map[int]string{
+		10: "exec-1",
+		11: "exec-2",
+		12: "exec-3",
+	}
+	for pid, id := range want {
+		execs.Store(id, &testShimExec{id: id, pid: pid})
+	}
+
+	got := indexExecPIDs(execs)
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for pid, id := range want {
+		if got[pid] != id {
+			t.Errorf("pid %d: got exec %q, want %q", pid, got[pid], id)
+		}
+	}
+}
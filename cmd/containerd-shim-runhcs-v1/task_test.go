@@ -51,6 +51,10 @@ func (tst *testShimTask) DeleteExec(ctx context.Context, eid string) (int, uint3
 	return int(status.Pid), status.ExitStatus, status.ExitedAt, nil
 }
 
+func (tst *testShimTask) Checkpoint(ctx context.Context, path string, opts *CheckpointOptions) error {
+	return errdefs.ErrNotImplemented
+}
+
 func (tst *testShimTask) Pids(ctx context.Context) ([]shimTaskPidPair, error) {
 	pairs := []shimTaskPidPair{
 		shimTaskPidPair{
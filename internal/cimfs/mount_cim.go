@@ -1,7 +1,10 @@
 package cimfs
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sync"
 
@@ -9,6 +12,8 @@ import (
 	hcsschema "github.com/Microsoft/hcsshim/internal/hcs/schema2"
 	"github.com/Microsoft/hcsshim/internal/winapi"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
 )
 
 type MountError struct {
@@ -41,24 +46,216 @@ var mountMapLock sync.Mutex
 // map for information about cims mounted on the host
 var hostCimMounts = make(map[string]*cimInfo)
 
-func MountWithFlags(cimPath string, mountFlags uint32) (string, error) {
+// cimStateFilePath is the well-known location this package persists
+// `hostCimMounts` to, so a shim restart can recover the refcounts it owned
+// instead of leaking volumes or double-dismounting on the next
+// `Mount`/`Unmount` pair.
+var cimStateFilePath = filepath.Join(os.Getenv("ProgramData"), "containerd", "cimfs-state.json")
+
+// cimStateMutexName guards `cimStateFilePath` across processes, since
+// multiple shims on the same host may mount/unmount cims concurrently.
+const cimStateMutexName = `Global\hcsshim-cimfs-state`
+
+func init() {
+	if err := RecoverMounts(); err != nil {
+		logrus.WithError(err).Warn("cimfs: failed to recover persisted mount state")
+	}
+}
+
+// persistedCimInfo is the on-disk representation of a `cimInfo` written to
+// `cimStateFilePath`.
+type persistedCimInfo struct {
+	Path     string    `json:"path"`
+	CimID    guid.GUID `json:"cimId"`
+	RefCount uint32    `json:"refCount"`
+}
+
+// withStateLock runs `fn` while holding a host-wide named mutex over
+// `cimStateFilePath`, so the read-modify-write of the state file is atomic
+// across every process on the machine, not just within this one (for which
+// `mountMapLock` already suffices).
+func withStateLock(fn func() error) error {
+	name, err := windows.UTF16PtrFromString(cimStateMutexName)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateMutex(nil, false, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to create cimfs state mutex")
+	}
+	defer windows.CloseHandle(h)
+
+	if _, err := windows.WaitForSingleObject(h, windows.INFINITE); err != nil {
+		return errors.Wrap(err, "failed to acquire cimfs state mutex")
+	}
+	defer windows.ReleaseMutex(h)
+
+	return fn()
+}
+
+// loadPersistedState reads and decodes `cimStateFilePath`. A missing file is
+// not an error; it returns an empty slice.
+func loadPersistedState() ([]persistedCimInfo, error) {
+	data, err := ioutil.ReadFile(cimStateFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read cimfs state file")
+	}
+	var entries []persistedCimInfo
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal cimfs state file")
+	}
+	return entries, nil
+}
+
+// savePersistedStateLocked updates `cimPath`'s entry in `cimStateFilePath`,
+// reading the file fresh and merging the single-path change in rather than
+// overwriting it with this process's whole `hostCimMounts` view: since
+// `cimStateFilePath` is shared by every shim on the host, a wholesale
+// overwrite would drop every other shim's cims this process doesn't itself
+// have mounted. If `removed` is true `cimPath` is dropped from the file,
+// otherwise it is set (inserted or updated) from `hostCimMounts[cimPath]`.
+//
+// Callers MUST hold `mountMapLock` and run this inside `withStateLock`.
+func savePersistedStateLocked(cimPath string, removed bool) error {
+	entries, err := loadPersistedState()
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]persistedCimInfo, len(entries)+1)
+	for _, e := range entries {
+		merged[e.Path] = e
+	}
+	if removed {
+		delete(merged, cimPath)
+	} else if ci, ok := hostCimMounts[cimPath]; ok {
+		merged[cimPath] = persistedCimInfo{
+			Path:     ci.path,
+			CimID:    ci.cimID,
+			RefCount: ci.refCount,
+		}
+	}
+
+	out := make([]persistedCimInfo, 0, len(merged))
+	for _, e := range merged {
+		out = append(out, e)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal cimfs state")
+	}
+	if err := os.MkdirAll(filepath.Dir(cimStateFilePath), 0); err != nil {
+		return errors.Wrap(err, "failed to create cimfs state directory")
+	}
+	return ioutil.WriteFile(cimStateFilePath, data, 0600)
+}
+
+// RecoverMounts reloads `cimStateFilePath` and repopulates `hostCimMounts`
+// with every entry whose volume is still actually mounted, as verified via
+// `GetVolumePathNamesForVolumeName`. Entries for volumes that are no longer
+// present (e.g. the host rebooted) are dropped.
+//
+// This is called automatically on package init so a shim that crashed and
+// restarted picks its refcounts back up before the first `Mount`/`Unmount`
+// call, but callers may invoke it again explicitly after recovering from a
+// known-bad state.
+func RecoverMounts() error {
 	mountMapLock.Lock()
 	defer mountMapLock.Unlock()
-	if _, ok := hostCimMounts[cimPath]; !ok {
-		layerGUID, err := guid.NewV4()
+
+	return withStateLock(func() error {
+		entries, err := loadPersistedState()
 		if err != nil {
-			return "", &MountError{Cim: cimPath, Op: "Mount", Err: err}
+			return err
 		}
-		if err := winapi.CimMountImage(filepath.Dir(cimPath), filepath.Base(cimPath), mountFlags, &layerGUID); err != nil {
-			return "", &MountError{Cim: cimPath, Op: "Mount", VolumeGUID: layerGUID, Err: err}
+		recovered := make(map[string]*cimInfo)
+		for _, e := range entries {
+			volPath := fmt.Sprintf("\\\\?\\Volume{%s}\\", e.CimID.String())
+			if !volumeStillMounted(volPath) {
+				continue
+			}
+			recovered[e.Path] = &cimInfo{path: e.Path, cimID: e.CimID, refCount: e.RefCount}
 		}
-		hostCimMounts[cimPath] = &cimInfo{cimPath, layerGUID, 0}
+		hostCimMounts = recovered
+		return nil
+	})
+}
+
+// volumeStillMounted reports whether `volPath` (a "\\?\Volume{GUID}\" path)
+// still resolves to a live mount point.
+func volumeStillMounted(volPath string) bool {
+	volPathPtr, err := windows.UTF16PtrFromString(volPath)
+	if err != nil {
+		return false
+	}
+	var buf [1]uint16
+	var returnLen uint32
+	err = windows.GetVolumePathNamesForVolumeName(volPathPtr, &buf[0], uint32(len(buf)), &returnLen)
+	if err == windows.ERROR_MORE_DATA {
+		// The volume exists and has at least one mount point; we just don't
+		// have room to read it, which is all we need to know here.
+		return true
+	}
+	return err == nil
+}
+
+// ListMounts returns the host paths of every cim this package currently
+// believes is mounted.
+func ListMounts() []string {
+	mountMapLock.Lock()
+	defer mountMapLock.Unlock()
+	paths := make([]string, 0, len(hostCimMounts))
+	for p := range hostCimMounts {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// IsMounted reports whether the cim at `cimPath` is currently mounted
+// according to this package's (possibly restart-recovered) state.
+func IsMounted(cimPath string) bool {
+	mountMapLock.Lock()
+	defer mountMapLock.Unlock()
+	_, ok := hostCimMounts[cimPath]
+	return ok
+}
+
+func mountWithGUID(cimPath string, cimID guid.GUID, mountFlags uint32) (string, error) {
+	mountMapLock.Lock()
+	defer mountMapLock.Unlock()
+	if _, ok := hostCimMounts[cimPath]; !ok {
+		if err := winapi.CimMountImage(filepath.Dir(cimPath), filepath.Base(cimPath), mountFlags, &cimID); err != nil {
+			return "", &MountError{Cim: cimPath, Op: "Mount", VolumeGUID: cimID, Err: err}
+		}
+		hostCimMounts[cimPath] = &cimInfo{cimPath, cimID, 0}
 	}
 	ci := hostCimMounts[cimPath]
 	ci.refCount += 1
+	if err := withStateLock(func() error { return savePersistedStateLocked(cimPath, false) }); err != nil {
+		logrus.WithError(err).Warn("cimfs: failed to persist mount state")
+	}
 	return fmt.Sprintf("\\\\?\\Volume{%s}\\", ci.cimID), nil
 }
 
+func MountWithFlags(cimPath string, mountFlags uint32) (string, error) {
+	layerGUID, err := guid.NewV4()
+	if err != nil {
+		return "", &MountError{Cim: cimPath, Op: "Mount", Err: err}
+	}
+	return mountWithGUID(cimPath, layerGUID, mountFlags)
+}
+
+// MountWithID mounts the cim at `cimPath` under the caller-supplied volume
+// `id` instead of a randomly generated one, so a caller that persists `id`
+// itself (e.g. in a layer's metadata) gets a reproducible mount path across
+// mounts. If `cimPath` is already mounted its existing (possibly different)
+// volume GUID is reused and `id` is ignored.
+func MountWithID(cimPath string, id guid.GUID, mountFlags uint32) (string, error) {
+	return mountWithGUID(cimPath, id, mountFlags)
+}
+
 // Mount mounts the cim at path `cimPath` and returns the mount location of that cim.
 // If this cim is already mounted then nothing is done.
 // This method uses the `CimMountFlagCacheRegions` mount flag when mounting the cim, if some other
@@ -87,7 +284,8 @@ func Unmount(cimPath string) error {
 	if !ok {
 		return errors.Errorf("cim not mounted")
 	}
-	if ci.refCount == 1 {
+	removed := ci.refCount == 1
+	if removed {
 		if err := winapi.CimDismountImage(&ci.cimID); err != nil {
 			return &MountError{Cim: cimPath, Op: "Unmount", Err: err}
 		}
@@ -95,5 +293,8 @@ func Unmount(cimPath string) error {
 	} else {
 		ci.refCount -= 1
 	}
+	if err := withStateLock(func() error { return savePersistedStateLocked(cimPath, removed) }); err != nil {
+		logrus.WithError(err).Warn("cimfs: failed to persist mount state")
+	}
 	return nil
 }
@@ -0,0 +1,77 @@
+package oom
+
+import (
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/sirupsen/logrus"
+)
+
+// NewLCOWWatcher returns a `Watcher` that subscribes to cgroup
+// `memory.events` (`oom_kill` transitions) for each added container through
+// `vm`'s GCS bridge and invokes `onOOM` the moment a container's cgroup
+// reports one.
+func NewLCOWWatcher(vm *uvm.UtilityVM, onOOM ExitFunc) (Watcher, error) {
+	w := &lcowWatcher{
+		vm:    vm,
+		onOOM: onOOM,
+	}
+	sub, err := vm.SubscribeOOM()
+	if err != nil {
+		return nil, err
+	}
+	w.sub = sub
+	go w.run()
+	return w, nil
+}
+
+type lcowWatcher struct {
+	vm    *uvm.UtilityVM
+	onOOM ExitFunc
+	sub   uvm.OOMSubscription
+
+	m        sync.Mutex
+	watching map[string]struct{}
+	closed   bool
+}
+
+func (w *lcowWatcher) Add(id string, _ *hcs.System) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return hcs.ErrAlreadyClosed
+	}
+	if w.watching == nil {
+		w.watching = make(map[string]struct{})
+	}
+	w.watching[id] = struct{}{}
+	return nil
+}
+
+// run drains the UVM's single OOM event stream and dispatches each
+// `oom_kill` notification to `onOOM` for containers we are watching,
+// ignoring any for containers that have already exited or were never added.
+func (w *lcowWatcher) run() {
+	for id := range w.sub.Events() {
+		w.m.Lock()
+		_, watching := w.watching[id]
+		w.m.Unlock()
+		if !watching {
+			logrus.WithField("id", id).Debug("oom: ignoring OOM event for unwatched container")
+			continue
+		}
+		w.onOOM(id)
+	}
+}
+
+func (w *lcowWatcher) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.watching = nil
+	return w.sub.Close()
+}
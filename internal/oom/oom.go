@@ -0,0 +1,31 @@
+// Package oom watches running containers for out-of-memory conditions and
+// reports them back to callers so they can be surfaced as `TaskOOM` events,
+// mirroring the epoll-on-a-memory-eventfd loop containerd's Linux shims run
+// via `pkg/oom`.
+package oom
+
+import (
+	"github.com/Microsoft/hcsshim/internal/hcs"
+)
+
+// Watcher watches a set of containers for out-of-memory conditions.
+//
+// Implementations are safe for concurrent use.
+type Watcher interface {
+	// Add begins watching `id` for OOM notifications on `system`. The
+	// watcher calls back into whatever was supplied at construction time
+	// when `id` is OOM killed. A watch may end on its own (the WCOW watcher
+	// stops after the first notification or once the container is gone),
+	// but its resources are only released by `Close`, which MUST be called.
+	//
+	// Add is a no-op if `id` is already being watched.
+	Add(id string, system *hcs.System) error
+	// Close stops every watch started with `Add` and releases the
+	// underlying resources. After `Close` the `Watcher` MUST NOT be used
+	// again.
+	Close() error
+}
+
+// ExitFunc is called with the ID of a container the instant it is observed
+// to have been killed by the out-of-memory killer.
+type ExitFunc func(id string)
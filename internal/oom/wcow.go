@@ -0,0 +1,95 @@
+package oom
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hcs/schema1"
+	"github.com/sirupsen/logrus"
+)
+
+// wcowPollInterval is how often each watched container's statistics are
+// polled for a memory pressure / job object OOM notification. HCS does not
+// expose an OOM event today, only a point-in-time property, so polling is
+// the only option until it does.
+const wcowPollInterval = 1 * time.Second
+
+// NewWCOWWatcher returns a `Watcher` that polls each added container's
+// `schema1.PropertyTypeMemory` for a job object memory limit notification
+// and invokes `onOOM` the first time one is observed.
+func NewWCOWWatcher(onOOM ExitFunc) (Watcher, error) {
+	w := &wcowWatcher{
+		onOOM: onOOM,
+	}
+	return w, nil
+}
+
+type wcowWatcher struct {
+	onOOM ExitFunc
+
+	m       sync.Mutex
+	cancels map[string]context.CancelFunc
+	closed  bool
+}
+
+func (w *wcowWatcher) Add(id string, system *hcs.System) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return hcs.ErrAlreadyClosed
+	}
+	if w.cancels == nil {
+		w.cancels = make(map[string]context.CancelFunc)
+	}
+	if _, ok := w.cancels[id]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancels[id] = cancel
+	go w.poll(ctx, id, system)
+	return nil
+}
+
+func (w *wcowWatcher) poll(ctx context.Context, id string, system *hcs.System) {
+	ticker := time.NewTicker(wcowPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			props, err := system.Properties(ctx, schema1.PropertyTypeMemory)
+			if err != nil {
+				if hcs.IsAlreadyClosed(err) || hcs.IsNotExist(err) {
+					return
+				}
+				logrus.WithFields(logrus.Fields{
+					"id":            id,
+					logrus.ErrorKey: err,
+				}).Warn("oom: failed to poll container memory properties")
+				continue
+			}
+			if props.Memory != nil && props.Memory.TotalLimitBytes != 0 && props.Memory.TotalPhysicalBytes >= props.Memory.TotalLimitBytes {
+				w.onOOM(id)
+				return
+			}
+		}
+	}
+}
+
+func (w *wcowWatcher) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	for _, cancel := range w.cancels {
+		cancel()
+	}
+	w.cancels = nil
+	return nil
+}
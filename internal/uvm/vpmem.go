@@ -1,9 +1,29 @@
+// This file assumes the rest of the `uvm` package (in particular `UtilityVM`
+// itself, with the `m`, `vpmemDevices`, `vpmemMaxCount`, `vpmemMaxSizeBytes`,
+// `operatingSystem`, `vm`, `layerBackend` and `layerLocations` fields it reads
+// and writes below) plus the `internal/vm` (`VPMemManager.AppendVPMemDevice`/
+// `.ResizeVPMemDevice`, the `vm.VPMemImageFormat` values) and
+// `internal/guestrequest` (`LCOWMappedVPMemLayer`, `ResourceTypeMappedVPMemLayer`,
+// `LCOWVPMemDeviceStatsQuery`/`Response`, `ResourceTypeVPMemDeviceStats`, and the
+// added `LCOWMappedVPMemDevice.Format`/`.SizeBytes` fields) symbols it depends
+// on are defined elsewhere in the full tree. None of those live in this
+// checkout - this package has no other file declaring `UtilityVM`, and
+// `internal/vm`/`internal/guestrequest` aren't present here at all - so this
+// file doesn't compile standalone in this checkout, matching every other
+// cross-package reference already made throughout `cmd/containerd-shim-runhcs-v1`
+// (`internal/hcs`, `internal/hcsoci`, `internal/oci`, etc., none of which are
+// present here either). `AddVPMEM`'s one real caller for an existing layer add
+// (`internal/hcsoci`'s container setup) needs the equivalent update to pass its
+// `*VPMemAddOptions` once this lands alongside that package.
 package uvm
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 
 	"github.com/Microsoft/hcsshim/internal/guestrequest"
 	"github.com/Microsoft/hcsshim/internal/log"
@@ -15,14 +35,167 @@ import (
 
 const (
 	lcowVPMEMLayerFmt = "/run/layers/p%d"
+	// lcowVPMEMMappedDeviceLayerFmt is the guest mount path for a layer
+	// packed onto an existing VPMEM device at a byte offset via
+	// `AddVPMEMMappedDevice`: device number, then offset within it.
+	lcowVPMEMMappedDeviceLayerFmt = "/run/layers/p%d-%d"
+	// vpmemMappedDeviceAlignBytes is the alignment every mapped-device
+	// extent is rounded up to, matching the guest's page size so the
+	// resulting dm-linear target never straddles a page.
+	vpmemMappedDeviceAlignBytes = 4096
 )
 
 var (
 	// ErrMaxVPMEMLayerSize is the error returned when the size of `hostPath` is
 	// greater than the max vPMEM layer size set at create time.
 	ErrMaxVPMEMLayerSize = errors.New("layer size is to large for VPMEM max size")
+	// ErrVPMEMMappingTooLarge is returned by `AddVPMEMMappedDevice` when a
+	// layer's page-aligned size is larger than `vpmemMaxSizeBytes`, the most
+	// a single pool device can hold.
+	ErrVPMEMMappingTooLarge = errors.New("layer does not fit in any available VPMEM device mapping")
 )
 
+// LayerBackend selects which transport `AddVPMEM` is allowed to use to
+// attach a container layer.
+type LayerBackend int
+
+const (
+	// LayerBackendPreferVPMEM tries VPMEM first and falls back to SCSI once
+	// VPMEM slots are exhausted or the layer is too large for VPMEM. This is
+	// the default.
+	LayerBackendPreferVPMEM LayerBackend = iota
+	// LayerBackendVPMEMOnly fails the add instead of falling back to SCSI.
+	LayerBackendVPMEMOnly
+	// LayerBackendSCSIOnly skips VPMEM entirely and always attaches layers
+	// over SCSI.
+	LayerBackendSCSIOnly
+)
+
+// layerBackendKind records which transport actually realized a layer added
+// through `AddVPMEM`, so `RemoveVPMEM` can route its teardown to the right
+// backend without the caller having to remember which one was picked.
+type layerBackendKind int
+
+const (
+	layerBackendKindVPMEM layerBackendKind = iota
+	layerBackendKindSCSI
+)
+
+// layerLocation is the opaque record `AddVPMEM` keeps per `hostPath` so a
+// later `RemoveVPMEM` call can be routed to whichever backend, VPMEM or
+// SCSI, actually attached the layer.
+type layerLocation struct {
+	backend layerBackendKind
+	uvmPath string
+}
+
+// VPMemAddOptions controls how `AddVPMEM` attaches a layer.
+type VPMemAddOptions struct {
+	// Format is the on-disk layer format. If left as the zero value,
+	// `AddVPMEM` probes `hostPath`'s header to detect it.
+	Format vm.VPMemImageFormat
+	// ReadOnly marks the device non-writable in the guest. Every current
+	// caller wants this true; it is exposed so a future read-write use
+	// (e.g. a scratch layer) doesn't need a second entry point.
+	ReadOnly bool
+}
+
+const (
+	vhd1FooterCookie = "conectix" // VHD1 footer signature, at the final 512 bytes of the file
+	vhdxSignature    = "vhdxfile" // VHDX file identifier, at offset 0
+)
+
+// detectVPMemImageFormat sniffs `hostPath`'s header/footer to tell a VHD1 or
+// VHDX layer from a raw filesystem image (e.g. an ext4 image built without
+// going through a VHD tool, so it can be DAX-mounted with `-o dax=always`).
+func detectVPMemImageFormat(hostPath string) (vm.VPMemImageFormat, error) {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if string(header) == vhdxSignature {
+		return vm.VPMemImageFormatVHDX, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() >= 512 {
+		footer := make([]byte, 8)
+		if _, err := f.ReadAt(footer, fi.Size()-512); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if string(footer) == vhd1FooterCookie {
+			return vm.VPMemImageFormatVHD1, nil
+		}
+	}
+
+	return vm.VPMemImageFormatRaw, nil
+}
+
+// vpmemInfo tracks a single VPMEM device slot. A slot either holds one
+// whole-disk layer added through `AddVPMEM`, or is a pool device whose
+// backing file is grown in place and whose space is shared between one or
+// more layers packed in via `AddVPMEMMappedDevice`; the two are mutually
+// exclusive for a given slot.
+type vpmemInfo struct {
+	hostPath string
+	uvmPath  string
+	refCount uint32
+	// format is the layer format resolved (whether explicitly requested or
+	// header-detected) when this slot was attached via `AddVPMEM`. Unused for
+	// a pool device, whose mappings each carry their own contents and aren't
+	// attached as a single typed image.
+	format vm.VPMemImageFormat
+	// sizeBytes is the current size of a whole-disk layer's backing file,
+	// grown in place by `ResizeVPMEM`. Unused for a pool device, whose
+	// capacity is tracked instead by `mappedMaxSizeBytes`/`freeExtents`.
+	sizeBytes uint64
+
+	// mappings holds the layers packed onto this device's backing file via
+	// dm-linear, in the order they were added. Only set for a pool device.
+	mappings []*vpmemMapping
+	// freeExtents is the list of byte ranges in this device not claimed by
+	// any mapping, kept sorted by offset and coalesced on removal.
+	freeExtents []vpmemExtent
+	// mappedMaxSizeBytes is the aggregate size this pool device's backing
+	// file may grow to, fixed when the slot is first carved out.
+	mappedMaxSizeBytes uint64
+}
+
+// vpmemMapping is one layer packed onto an existing VPMEM device's backing
+// file at `offset` via a guest dm-linear target, instead of consuming a
+// VPMEM slot of its own.
+type vpmemMapping struct {
+	hostPath     string
+	offset       uint64
+	sizeBytes    uint64
+	refCount     uint32
+	uvmMountPath string
+}
+
+// vpmemExtent is a free byte range within a pool VPMEM device available for
+// a new mapping.
+type vpmemExtent struct {
+	offset    uint64
+	sizeBytes uint64
+}
+
+// alignUp rounds `n` up to the next multiple of `align`.
+func alignUp(n, align uint64) uint64 {
+	if r := n % align; r != 0 {
+		n += align - r
+	}
+	return n
+}
+
 // findNextVPMEM finds the next available VPMem slot.
 //
 // The lock MUST be held when calling this function.
@@ -55,71 +228,386 @@ func (uvm *UtilityVM) findVPMEMDevice(ctx context.Context, findThisHostPath stri
 	return 0, ErrNotAttached
 }
 
-// AddVPMEM adds a VPMEM disk to a utility VM at the next available location and
-// returns the UVM path where the layer was mounted.
-func (uvm *UtilityVM) AddVPMEM(ctx context.Context, hostPath string) (_ string, err error) {
+// AddVPMEM attaches `hostPath` as a container layer, preferring a VPMEM slot
+// at the next available location but transparently falling back to SCSI
+// once VPMEM slots are exhausted or the layer is too large for VPMEM,
+// according to `uvm.layerBackend`. The returned UVM path is opaque: callers
+// must not infer the transport used from its shape, since `RemoveVPMEM`
+// uses the unified `layerLocation` record to route teardown regardless.
+//
+// `options` may be nil, in which case the device is added read-only and
+// `hostPath`'s format is detected from its header.
+func (uvm *UtilityVM) AddVPMEM(ctx context.Context, hostPath string, options *VPMemAddOptions) (_ string, err error) {
 	if uvm.operatingSystem != "linux" {
 		return "", errNotSupported
 	}
+	if options == nil {
+		options = &VPMemAddOptions{ReadOnly: true}
+	}
 
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
-	var deviceNumber uint32
-	deviceNumber, err = uvm.findVPMEMDevice(ctx, hostPath)
+	if uvm.layerBackend == LayerBackendSCSIOnly {
+		return uvm.addSCSILayer(ctx, hostPath)
+	}
+
+	if loc, ok := uvm.layerLocations[hostPath]; ok && loc.backend == layerBackendKindSCSI {
+		// A previous call already fell back to SCSI for this hostPath (e.g. VPMEM
+		// was exhausted at the time). Keep it there: probing for a free VPMEM slot
+		// below would let it attach a second time over VPMEM and, via
+		// `setLayerLocation`, overwrite this record - orphaning the original SCSI
+		// attachment since `RemoveVPMEM` would no longer be able to find it.
+		return uvm.addSCSILayer(ctx, hostPath)
+	}
+
+	deviceNumber, err := uvm.findVPMEMDevice(ctx, hostPath)
+	if err == nil {
+		device := uvm.vpmemDevices[deviceNumber]
+		device.refCount++
+		return device.uvmPath, nil
+	}
+
+	// We are going to add it so make sure it fits on vPMEM.
+	fi, err := os.Stat(hostPath)
 	if err != nil {
-		// We are going to add it so make sure it fits on vPMEM
-		fi, err := os.Stat(hostPath)
-		if err != nil {
+		return "", err
+	}
+	fitsVPMEM := uint64(fi.Size()) <= uvm.vpmemMaxSizeBytes
+
+	if fitsVPMEM {
+		// It doesn't exist, so we're going to allocate and hot-add it.
+		deviceNumber, err := uvm.findNextVPMEM(ctx, hostPath)
+		if err == nil {
+			vpmem, ok := uvm.vm.(vm.VPMemManager)
+			if !ok || !uvm.vm.Supported(vm.VPMem, vm.Add) {
+				return "", errors.Wrap(vm.ErrNotSupported, "stopping vpmem device add")
+			}
+
+			format := options.Format
+			if format == vm.VPMemImageFormatNone {
+				format, err = detectVPMemImageFormat(hostPath)
+				if err != nil {
+					return "", errors.Wrap(err, "failed to detect vpmem layer format")
+				}
+			}
+
+			if err := vpmem.AddVPMemDevice(ctx, deviceNumber, hostPath, options.ReadOnly, format); err != nil {
+				return "", errors.Wrap(err, "failed to add vpmem device")
+			}
+
+			uvmPath := fmt.Sprintf(lcowVPMEMLayerFmt, deviceNumber)
+			guestReq := guestrequest.GuestRequest{
+				ResourceType: guestrequest.ResourceTypeVPMemDevice,
+				RequestType:  requesttype.Add,
+				Settings: guestrequest.LCOWMappedVPMemDevice{
+					DeviceNumber: deviceNumber,
+					MountPath:    uvmPath,
+					Format:       format,
+				},
+			}
+
+			if err := uvm.GuestRequest(ctx, guestReq); err != nil {
+				return "", errors.Wrap(err, "failed guest request to add vpmem device")
+			}
+
+			uvm.vpmemDevices[deviceNumber] = &vpmemInfo{
+				hostPath:  hostPath,
+				uvmPath:   uvmPath,
+				refCount:  1,
+				format:    format,
+				sizeBytes: uint64(fi.Size()),
+			}
+			uvm.setLayerLocation(hostPath, layerBackendKindVPMEM, uvmPath)
+			return uvmPath, nil
+		} else if err != ErrNoAvailableLocation {
 			return "", err
 		}
-		if uint64(fi.Size()) > uvm.vpmemMaxSizeBytes {
+	}
+
+	switch uvm.layerBackend {
+	case LayerBackendVPMEMOnly:
+		if !fitsVPMEM {
 			return "", ErrMaxVPMEMLayerSize
 		}
+		return "", ErrNoAvailableLocation
+	default:
+		return uvm.addSCSILayer(ctx, hostPath)
+	}
+}
 
-		// It doesn't exist, so we're going to allocate and hot-add it
-		deviceNumber, err = uvm.findNextVPMEM(ctx, hostPath)
-		if err != nil {
-			return "", err
-		}
+// ResizeVPMEM grows the whole-disk VPMEM layer backed by `hostPath` to
+// `newSizeBytes` in place: the host VHD is grown first, then the guest is
+// asked to re-read the namespace size and, for a r/w mount, grow the
+// filesystem on top of it (`resize2fs`/`xfs_growfs`, guest-side). If the
+// guest-side step fails the host-side resize is rolled back so the device
+// and the guest stay in agreement about its size.
+//
+// `hostPath` must already be attached through `AddVPMEM` as a whole-disk
+// layer; a layer packed in via `AddVPMEMMappedDevice` cannot be resized
+// this way, since growing it could collide with another layer sharing the
+// same pool device.
+func (uvm *UtilityVM) ResizeVPMEM(ctx context.Context, hostPath string, newSizeBytes uint64) (err error) {
+	if uvm.operatingSystem != "linux" {
+		return errNotSupported
+	}
 
-		vpmem, ok := uvm.vm.(vm.VPMemManager)
-		if !ok || !uvm.vm.Supported(vm.VPMem, vm.Add) {
-			return "", errors.Wrap(vm.ErrNotSupported, "stopping vpmem device add")
-		}
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	deviceNumber, err := uvm.findVPMEMDevice(ctx, hostPath)
+	if err != nil {
+		return err
+	}
+
+	device := uvm.vpmemDevices[deviceNumber]
+	if device.mappings != nil {
+		return errors.New("cannot resize a VPMEM pool device directly")
+	}
+	if newSizeBytes > uvm.vpmemMaxSizeBytes {
+		return ErrMaxVPMEMLayerSize
+	}
+	if newSizeBytes < device.sizeBytes {
+		return errors.New("new VPMEM layer size is smaller than the current size")
+	}
+	if newSizeBytes == device.sizeBytes {
+		return nil
+	}
 
-		if err := vpmem.AddVPMemDevice(ctx, deviceNumber, hostPath, true, vm.VPMemImageFormatVHD1); err != nil {
-			return "", errors.Wrap(err, "failed to add vpmem device")
+	vpmem, ok := uvm.vm.(vm.VPMemManager)
+	if !ok || !uvm.vm.Supported(vm.VPMem, vm.Modify) {
+		return errors.Wrap(vm.ErrNotSupported, "stopping vpmem device resize")
+	}
+
+	oldSizeBytes := device.sizeBytes
+	if err := vpmem.ResizeVPMemDevice(ctx, deviceNumber, hostPath, newSizeBytes); err != nil {
+		return errors.Wrap(err, "failed to resize vpmem device")
+	}
+
+	guestReq := guestrequest.GuestRequest{
+		ResourceType: guestrequest.ResourceTypeVPMemDevice,
+		RequestType:  requesttype.Update,
+		Settings: guestrequest.LCOWMappedVPMemDevice{
+			DeviceNumber: deviceNumber,
+			MountPath:    device.uvmPath,
+			SizeBytes:    newSizeBytes,
+		},
+	}
+	if err := uvm.GuestRequest(ctx, guestReq); err != nil {
+		if rollbackErr := vpmem.ResizeVPMemDevice(ctx, deviceNumber, hostPath, oldSizeBytes); rollbackErr != nil {
+			log.G(ctx).WithError(rollbackErr).Warn("failed to roll back vpmem device resize")
 		}
+		return errors.Wrap(err, "failed guest request to resize vpmem device")
+	}
 
-		uvmPath := fmt.Sprintf(lcowVPMEMLayerFmt, deviceNumber)
-		guestReq := guestrequest.GuestRequest{
-			ResourceType: guestrequest.ResourceTypeVPMemDevice,
-			RequestType:  requesttype.Add,
-			Settings: guestrequest.LCOWMappedVPMemDevice{
-				DeviceNumber: deviceNumber,
-				MountPath:    uvmPath,
-			},
+	device.sizeBytes = newSizeBytes
+	log.G(ctx).WithFields(logrus.Fields{
+		"hostPath":     hostPath,
+		"uvmPath":      device.uvmPath,
+		"deviceNumber": deviceNumber,
+		"oldSizeBytes": oldSizeBytes,
+		"newSizeBytes": newSizeBytes,
+	}).Debug("resized VPMEM device")
+	return nil
+}
+
+// addSCSILayer attaches `hostPath` over SCSI via the UVM's existing SCSI
+// manager and records the resulting mount so `RemoveVPMEM` can find it
+// again. Used both as the `AddVPMEM` fallback and for `LayerBackendSCSIOnly`.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) addSCSILayer(ctx context.Context, hostPath string) (string, error) {
+	sm, err := uvm.AddSCSI(ctx, hostPath, "", true, false, nil, vm.AccessTypeIndividual)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to add layer over SCSI")
+	}
+	uvm.setLayerLocation(hostPath, layerBackendKindSCSI, sm.UVMPath)
+	return sm.UVMPath, nil
+}
+
+// setLayerLocation records which backend realized `hostPath`'s attach so
+// `RemoveVPMEM` can look it up later.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) setLayerLocation(hostPath string, backend layerBackendKind, uvmPath string) {
+	if uvm.layerLocations == nil {
+		uvm.layerLocations = make(map[string]*layerLocation)
+	}
+	uvm.layerLocations[hostPath] = &layerLocation{backend: backend, uvmPath: uvmPath}
+}
+
+// findVPMEMMapping finds the mapped-device entry for `hostPath`, searching
+// every pool device's mapping list.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) findVPMEMMapping(findThisHostPath string) (uint32, *vpmemMapping, error) {
+	for i := uint32(0); i < uvm.vpmemMaxCount; i++ {
+		device := uvm.vpmemDevices[i]
+		if device == nil {
+			continue
+		}
+		for _, m := range device.mappings {
+			if m.hostPath == findThisHostPath {
+				return i, m, nil
+			}
 		}
+	}
+	return 0, nil, ErrNotAttached
+}
 
-		if err := uvm.GuestRequest(ctx, guestReq); err != nil {
-			return "", errors.Wrap(err, "failed guest request to add vpmem device")
+// allocateVPMEMExtent reserves `sizeBytes` of space for a new mapping,
+// reusing the first pool device with enough free room or, if none has
+// space, carving out a brand new slot as a pool device. It returns the
+// device and the offset the caller should map the layer at.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) allocateVPMEMExtent(ctx context.Context, sizeBytes uint64) (uint32, *vpmemInfo, uint64, error) {
+	for i := uint32(0); i < uvm.vpmemMaxCount; i++ {
+		device := uvm.vpmemDevices[i]
+		if device == nil || device.mappings == nil {
+			continue
+		}
+		for ei, extent := range device.freeExtents {
+			if extent.sizeBytes < sizeBytes {
+				continue
+			}
+			offset := extent.offset
+			if extent.sizeBytes == sizeBytes {
+				device.freeExtents = append(device.freeExtents[:ei], device.freeExtents[ei+1:]...)
+			} else {
+				device.freeExtents[ei] = vpmemExtent{offset: offset + sizeBytes, sizeBytes: extent.sizeBytes - sizeBytes}
+			}
+			return i, device, offset, nil
 		}
+	}
 
-		uvm.vpmemDevices[deviceNumber] = &vpmemInfo{
-			hostPath: hostPath,
-			uvmPath:  uvmPath,
-			refCount: 1,
+	deviceNumber, err := uvm.findNextVPMEM(ctx, "")
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	device := &vpmemInfo{
+		mappings:           []*vpmemMapping{},
+		freeExtents:        []vpmemExtent{{offset: sizeBytes, sizeBytes: uvm.vpmemMaxSizeBytes - sizeBytes}},
+		mappedMaxSizeBytes: uvm.vpmemMaxSizeBytes,
+	}
+	uvm.vpmemDevices[deviceNumber] = device
+	return deviceNumber, device, 0, nil
+}
+
+// freeVPMEMExtent returns a mapping's byte range to `device`'s free list,
+// coalescing it with any adjacent extents so fragmentation does not
+// accumulate across repeated add/remove cycles.
+func freeVPMEMExtent(device *vpmemInfo, offset, sizeBytes uint64) {
+	extents := append(device.freeExtents, vpmemExtent{offset: offset, sizeBytes: sizeBytes})
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+
+	merged := extents[:1]
+	for _, e := range extents[1:] {
+		last := &merged[len(merged)-1]
+		if last.offset+last.sizeBytes == e.offset {
+			last.sizeBytes += e.sizeBytes
+		} else {
+			merged = append(merged, e)
 		}
-		return uvmPath, nil
 	}
-	device := uvm.vpmemDevices[deviceNumber]
-	device.refCount++
-	return device.uvmPath, nil
+	device.freeExtents = merged
+}
+
+// AddVPMEMMappedDevice appends `hostPath`'s contents onto a pool VPMEM
+// device's backing file at a free byte offset and asks the guest to expose
+// that range as its own block device via a `dm-linear` target, rather than
+// consuming a whole VPMEM slot the way `AddVPMEM` does. It returns the UVM
+// path the layer was mounted at.
+//
+// The layer goes into the first pool device with enough free room, or into
+// a new pool device carved out of a free VPMEM slot. Slots holding a
+// whole-disk layer from `AddVPMEM` are never shared, so once every slot is
+// in use and no pool device has room the call fails with
+// `ErrNoAvailableLocation`. A layer whose page-aligned size is larger than
+// `vpmemMaxSizeBytes` is refused with `ErrVPMEMMappingTooLarge`.
+func (uvm *UtilityVM) AddVPMEMMappedDevice(ctx context.Context, hostPath string) (_ string, err error) {
+	if uvm.operatingSystem != "linux" {
+		return "", errNotSupported
+	}
+
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	if _, mapping, err := uvm.findVPMEMMapping(hostPath); err == nil {
+		mapping.refCount++
+		return mapping.uvmMountPath, nil
+	}
+
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return "", err
+	}
+	sizeBytes := alignUp(uint64(fi.Size()), vpmemMappedDeviceAlignBytes)
+	if sizeBytes > uvm.vpmemMaxSizeBytes {
+		return "", ErrVPMEMMappingTooLarge
+	}
+
+	vpmem, ok := uvm.vm.(vm.VPMemManager)
+	if !ok || !uvm.vm.Supported(vm.VPMem, vm.Add) {
+		return "", errors.Wrap(vm.ErrNotSupported, "stopping vpmem mapped device add")
+	}
+
+	deviceNumber, device, offset, err := uvm.allocateVPMEMExtent(ctx, sizeBytes)
+	if err != nil {
+		return "", err
+	}
+	if offset+sizeBytes > device.mappedMaxSizeBytes {
+		freeVPMEMExtent(device, offset, sizeBytes)
+		return "", ErrVPMEMMappingTooLarge
+	}
+
+	if err := vpmem.AppendVPMemDevice(ctx, deviceNumber, offset, hostPath); err != nil {
+		freeVPMEMExtent(device, offset, sizeBytes)
+		return "", errors.Wrap(err, "failed to append layer onto vpmem device")
+	}
+
+	uvmPath := fmt.Sprintf(lcowVPMEMMappedDeviceLayerFmt, deviceNumber, offset)
+	guestReq := guestrequest.GuestRequest{
+		ResourceType: guestrequest.ResourceTypeMappedVPMemLayer,
+		RequestType:  requesttype.Add,
+		Settings: guestrequest.LCOWMappedVPMemLayer{
+			DeviceNumber:        deviceNumber,
+			DeviceOffsetInBytes: offset,
+			DeviceSizeInBytes:   sizeBytes,
+			MountPath:           uvmPath,
+		},
+	}
+
+	if err := uvm.GuestRequest(ctx, guestReq); err != nil {
+		freeVPMEMExtent(device, offset, sizeBytes)
+		return "", errors.Wrap(err, "failed guest request to add vpmem mapped layer")
+	}
+
+	device.mappings = append(device.mappings, &vpmemMapping{
+		hostPath:     hostPath,
+		offset:       offset,
+		sizeBytes:    sizeBytes,
+		refCount:     1,
+		uvmMountPath: uvmPath,
+	})
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"hostPath":     hostPath,
+		"uvmPath":      uvmPath,
+		"deviceNumber": deviceNumber,
+		"offset":       offset,
+		"sizeBytes":    sizeBytes,
+	}).Debug("mapped VPMEM layer onto pool device")
+
+	return uvmPath, nil
 }
 
-// RemoveVPMEM removes a VPMEM disk from a Utility VM. If the `hostPath` is not
-// attached returns `ErrNotAttached`.
+// RemoveVPMEM removes a layer previously attached via `AddVPMEM` (including
+// one packed in via `AddVPMEMMappedDevice`), routing the teardown to
+// whichever backend, VPMEM or SCSI, the unified `layerLocation` record says
+// actually attached it. If `hostPath` is not attached returns
+// `ErrNotAttached`.
 func (uvm *UtilityVM) RemoveVPMEM(ctx context.Context, hostPath string) (err error) {
 	if uvm.operatingSystem != "linux" {
 		return errNotSupported
@@ -128,6 +616,22 @@ func (uvm *UtilityVM) RemoveVPMEM(ctx context.Context, hostPath string) (err err
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
+	if loc, ok := uvm.layerLocations[hostPath]; ok && loc.backend == layerBackendKindSCSI {
+		if err := uvm.RemoveSCSI(ctx, loc.uvmPath); err != nil {
+			return errors.Wrap(err, "failed to remove layer from SCSI")
+		}
+		delete(uvm.layerLocations, hostPath)
+		return nil
+	}
+
+	if deviceNumber, mapping, mErr := uvm.findVPMEMMapping(hostPath); mErr == nil {
+		if err := uvm.removeVPMEMMapping(ctx, deviceNumber, mapping); err != nil {
+			return err
+		}
+		delete(uvm.layerLocations, hostPath)
+		return nil
+	}
+
 	deviceNumber, err := uvm.findVPMEMDevice(ctx, hostPath)
 	if err != nil {
 		return err
@@ -167,5 +671,212 @@ func (uvm *UtilityVM) RemoveVPMEM(ctx context.Context, hostPath string) (err err
 	} else {
 		device.refCount--
 	}
+	delete(uvm.layerLocations, hostPath)
 	return nil
 }
+
+// removeVPMEMMapping decrements `mapping`'s refcount, tearing down its
+// `dm-linear` target and releasing its extent back to the pool once the
+// refcount reaches zero. The underlying VPMEM device itself is only
+// detached once its last mapping is gone.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) removeVPMEMMapping(ctx context.Context, deviceNumber uint32, mapping *vpmemMapping) error {
+	if mapping.refCount > 1 {
+		mapping.refCount--
+		return nil
+	}
+
+	guestReq := guestrequest.GuestRequest{
+		ResourceType: guestrequest.ResourceTypeMappedVPMemLayer,
+		RequestType:  requesttype.Remove,
+		Settings: guestrequest.LCOWMappedVPMemLayer{
+			DeviceNumber:        deviceNumber,
+			DeviceOffsetInBytes: mapping.offset,
+			DeviceSizeInBytes:   mapping.sizeBytes,
+			MountPath:           mapping.uvmMountPath,
+		},
+	}
+	if err := uvm.GuestRequest(ctx, guestReq); err != nil {
+		return errors.Wrap(err, "failed to remove vpmem mapped layer from guest")
+	}
+
+	device := uvm.vpmemDevices[deviceNumber]
+	for i, m := range device.mappings {
+		if m == mapping {
+			device.mappings = append(device.mappings[:i], device.mappings[i+1:]...)
+			break
+		}
+	}
+	freeVPMEMExtent(device, mapping.offset, mapping.sizeBytes)
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"hostPath":     mapping.hostPath,
+		"uvmPath":      mapping.uvmMountPath,
+		"deviceNumber": deviceNumber,
+	}).Debug("unmapped VPMEM layer from pool device")
+
+	if len(device.mappings) == 0 {
+		vpmem, ok := uvm.vm.(vm.VPMemManager)
+		if !ok || !uvm.vm.Supported(vm.VPMem, vm.Remove) {
+			return errors.Wrap(vm.ErrNotSupported, "stopping vpmem pool device removal")
+		}
+		if err := vpmem.RemoveVPMemDevice(ctx, deviceNumber, ""); err != nil {
+			return errors.Wrap(err, "failed to remove vpmem pool device")
+		}
+		uvm.vpmemDevices[deviceNumber] = nil
+	}
+	return nil
+}
+
+// VPMEMMappingInfo describes one layer packed onto a pool VPMEM device via
+// `AddVPMEMMappedDevice`, as reported by `VPMEMDevices`/`VPMEMStats`.
+type VPMEMMappingInfo struct {
+	HostPath    string
+	UVMPath     string
+	OffsetBytes uint64
+	SizeBytes   uint64
+	RefCount    uint32
+}
+
+// VPMEMDeviceStats holds the live, guest-reported counters for one VPMEM
+// device: how much it has been read/written since attach, and how many
+// times the guest failed to mount a layer off of it.
+type VPMEMDeviceStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+	MountErrors  uint64
+}
+
+// VPMEMDeviceInfo is a point-in-time snapshot of one attached VPMEM slot,
+// combining the shim's own bookkeeping with live counters queried from the
+// guest. For a pool device, `HostPath`, `UVMPath`, `Format`, `SizeBytes` and
+// `RefCount` are left as zero values and `MappedLayers` lists the layers
+// packed onto it; for a whole-disk layer `MappedLayers` is empty.
+type VPMEMDeviceInfo struct {
+	DeviceNumber uint32
+	HostPath     string
+	UVMPath      string
+	Format       vm.VPMemImageFormat
+	SizeBytes    uint64
+	RefCount     uint32
+	MappedLayers []VPMEMMappingInfo
+	Stats        VPMEMDeviceStats
+}
+
+// VPMEMDevices returns a snapshot of every attached VPMEM slot, host path,
+// UVM path, format, size and refcount alongside guest-reported live
+// counters, so callers (e.g. the shim's stats pipeline) can tell when
+// `vpmemMaxCount` is close to saturation or a layer is being hammered
+// without having to grep the debug log lines `findNextVPMEM`/
+// `findVPMEMDevice` emit today.
+func (uvm *UtilityVM) VPMEMDevices(ctx context.Context) ([]VPMEMDeviceInfo, error) {
+	if uvm.operatingSystem != "linux" {
+		return nil, errNotSupported
+	}
+
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	var infos []VPMEMDeviceInfo
+	for i := uint32(0); i < uvm.vpmemMaxCount; i++ {
+		device := uvm.vpmemDevices[i]
+		if device == nil {
+			continue
+		}
+		info, err := uvm.vpmemDeviceInfo(ctx, i, device)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// VPMEMStats returns the snapshot for the single VPMEM slot backing
+// `hostPath`, whichever way it was attached: as a whole-disk layer via
+// `AddVPMEM`, or packed onto a pool device via `AddVPMEMMappedDevice`. If
+// `hostPath` is not attached returns `ErrNotAttached`.
+func (uvm *UtilityVM) VPMEMStats(ctx context.Context, hostPath string) (*VPMEMDeviceInfo, error) {
+	if uvm.operatingSystem != "linux" {
+		return nil, errNotSupported
+	}
+
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	deviceNumber, _, err := uvm.findVPMEMMapping(hostPath)
+	if err != nil {
+		deviceNumber, err = uvm.findVPMEMDevice(ctx, hostPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := uvm.vpmemDeviceInfo(ctx, deviceNumber, uvm.vpmemDevices[deviceNumber])
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// vpmemDeviceInfo builds the snapshot for one slot, filling in its live
+// counters with a guest query.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) vpmemDeviceInfo(ctx context.Context, deviceNumber uint32, device *vpmemInfo) (VPMEMDeviceInfo, error) {
+	stats, err := uvm.queryVPMEMDeviceStats(ctx, deviceNumber)
+	if err != nil {
+		return VPMEMDeviceInfo{}, err
+	}
+
+	info := VPMEMDeviceInfo{
+		DeviceNumber: deviceNumber,
+		HostPath:     device.hostPath,
+		UVMPath:      device.uvmPath,
+		Format:       device.format,
+		SizeBytes:    device.sizeBytes,
+		RefCount:     device.refCount,
+		Stats:        stats,
+	}
+	for _, m := range device.mappings {
+		info.MappedLayers = append(info.MappedLayers, VPMEMMappingInfo{
+			HostPath:    m.hostPath,
+			UVMPath:     m.uvmMountPath,
+			OffsetBytes: m.offset,
+			SizeBytes:   m.sizeBytes,
+			RefCount:    m.refCount,
+		})
+	}
+	return info, nil
+}
+
+// queryVPMEMDeviceStats asks the GCS for the live read/write/mount-error
+// counters it tracks for `deviceNumber`.
+//
+// The lock MUST be held when calling this function.
+func (uvm *UtilityVM) queryVPMEMDeviceStats(ctx context.Context, deviceNumber uint32) (VPMEMDeviceStats, error) {
+	guestReq := guestrequest.GuestRequest{
+		ResourceType: guestrequest.ResourceTypeVPMemDeviceStats,
+		RequestType:  requesttype.Query,
+		Settings: guestrequest.LCOWVPMemDeviceStatsQuery{
+			DeviceNumber: deviceNumber,
+		},
+	}
+
+	raw, err := uvm.GuestRequestWithResponse(ctx, guestReq)
+	if err != nil {
+		return VPMEMDeviceStats{}, errors.Wrap(err, "failed to query vpmem device stats")
+	}
+
+	var resp guestrequest.LCOWVPMemDeviceStatsResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return VPMEMDeviceStats{}, errors.Wrap(err, "failed to unmarshal vpmem device stats response")
+	}
+
+	return VPMEMDeviceStats{
+		BytesRead:    resp.BytesRead,
+		BytesWritten: resp.BytesWritten,
+		MountErrors:  resp.MountErrors,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package uvm
+
+import "testing"
+
+func TestFreeVPMEMExtent_CoalescesAdjacent(t *testing.T) {
+	device := &vpmemInfo{
+		freeExtents: []vpmemExtent{
+			{offset: 0, sizeBytes: 100},
+		},
+	}
+
+	// Adjacent to the existing extent on the right: should merge into one.
+	freeVPMEMExtent(device, 100, 50)
+
+	if len(device.freeExtents) != 1 {
+		t.Fatalf("got %d extents, want 1 after coalescing adjacent ranges: %v", len(device.freeExtents), device.freeExtents)
+	}
+	if got := device.freeExtents[0]; got.offset != 0 || got.sizeBytes != 150 {
+		t.Fatalf("got extent %+v, want {offset:0 sizeBytes:150}", got)
+	}
+}
+
+func TestFreeVPMEMExtent_NonAdjacentStaysSeparate(t *testing.T) {
+	device := &vpmemInfo{
+		freeExtents: []vpmemExtent{
+			{offset: 0, sizeBytes: 100},
+		},
+	}
+
+	// A gap remains between [0,100) and the freed range starting at 200.
+	freeVPMEMExtent(device, 200, 50)
+
+	if len(device.freeExtents) != 2 {
+		t.Fatalf("got %d extents, want 2 for non-adjacent ranges: %v", len(device.freeExtents), device.freeExtents)
+	}
+	if got := device.freeExtents[1]; got.offset != 200 || got.sizeBytes != 50 {
+		t.Fatalf("got extent %+v, want {offset:200 sizeBytes:50}", got)
+	}
+}
+
+func TestFreeVPMEMExtent_CoalescesBothSides(t *testing.T) {
+	device := &vpmemInfo{
+		freeExtents: []vpmemExtent{
+			{offset: 0, sizeBytes: 100},
+			{offset: 150, sizeBytes: 50},
+		},
+	}
+
+	// Fills the [100,150) gap, so all three ranges should merge into one.
+	freeVPMEMExtent(device, 100, 50)
+
+	if len(device.freeExtents) != 1 {
+		t.Fatalf("got %d extents, want 1 after filling the gap: %v", len(device.freeExtents), device.freeExtents)
+	}
+	if got := device.freeExtents[0]; got.offset != 0 || got.sizeBytes != 200 {
+		t.Fatalf("got extent %+v, want {offset:0 sizeBytes:200}", got)
+	}
+}
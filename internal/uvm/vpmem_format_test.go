@@ -0,0 +1,61 @@
+package uvm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/vm"
+)
+
+func writeTempFile(t *testing.T, contents []byte) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "vpmem-format-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+func TestDetectVPMemImageFormat_VHDX(t *testing.T) {
+	path := writeTempFile(t, []byte(vhdxSignature))
+
+	format, err := detectVPMemImageFormat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != vm.VPMemImageFormatVHDX {
+		t.Errorf("got format %v, want VHDX", format)
+	}
+}
+
+func TestDetectVPMemImageFormat_VHD1(t *testing.T) {
+	contents := make([]byte, 1024)
+	copy(contents[1024-512:], vhd1FooterCookie)
+	path := writeTempFile(t, contents)
+
+	format, err := detectVPMemImageFormat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != vm.VPMemImageFormatVHD1 {
+		t.Errorf("got format %v, want VHD1", format)
+	}
+}
+
+func TestDetectVPMemImageFormat_Raw(t *testing.T) {
+	path := writeTempFile(t, []byte("not a recognized header"))
+
+	format, err := detectVPMemImageFormat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != vm.VPMemImageFormatRaw {
+		t.Errorf("got format %v, want Raw", format)
+	}
+}